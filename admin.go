@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"appengine"
@@ -20,16 +22,49 @@ func init() {
 	http.HandleFunc("/_ah/value/update", updateHandler)
 }
 
+// page is the data passed to adminTmpl.
+type page struct {
+	// NS is the namespace the page is scoped to, from the ?ns= querystring.
+	NS   string
+	Rows map[string]row
+}
+
+// row is what the admin template renders for each stored value.
+type row struct {
+	Value     string
+	Encrypted bool
+	// InputType is the HTML input type= attribute for Value, based on the
+	// kind registered for this key (e.g. via Bool or Int), or "text" if
+	// the key has no registered binding.
+	InputType string
+	// Version is submitted back as expected_version when the row is
+	// saved, so concurrent edits are caught as a version mismatch.
+	Version int64
+}
+
 var adminTmpl = template.Must(template.New("admin").Parse(`<html><body>
 <h1>Admin</h1>
+<form action="/_ah/value/admin" method="GET">
+  Namespace: <input type="text" name="ns" value="{{.NS}}"></input>
+  <input type="submit" value="Switch"></input>
+</form>
 <table>
-{{range $key, $val := .}}
+{{$ns := .NS}}
+{{range $key, $row := .Rows}}
   <form action="/_ah/value/update" method="POST">
     <tr>
-    <input type="hidden" name="delete_key" value="{{$key}}"></input>
+    <input type="hidden" name="ns" value="{{$ns}}"></input>
+    <input type="hidden" name="key" value="{{$key}}"></input>
+    <input type="hidden" name="expected_version" value="{{$row.Version}}"></input>
     <td>{{$key}}</td>
-    <td>{{$val}}</td>
-    <td><input type="submit" value="Delete"></input></td>
+    <td>{{if $row.Encrypted}}(encrypted)
+      {{else if eq $row.InputType "checkbox"}}<input type="checkbox" name="val" value="true"{{if eq $row.Value "true"}} checked{{end}}></input>
+      {{else}}<input type="{{$row.InputType}}" name="val" value="{{$row.Value}}"></input>
+      {{end}}</td>
+    <td>
+      {{if not $row.Encrypted}}<input type="submit" name="action" value="Save"></input>{{end}}
+      <input type="submit" name="action" value="Delete"></input>
+    </td>
     </tr>
   </form>
 {{else}}
@@ -37,9 +72,10 @@ var adminTmpl = template.Must(template.New("admin").Parse(`<html><body>
 {{end}}
 <form action="/_ah/value/update" method="POST">
   <tr>
+  <input type="hidden" name="ns" value="{{.NS}}"></input>
   <td><input type="text" name="key"></input></td>
   <td><input type="text" name="val"></input></td>
-  <td><input type="submit" value="Add"></input></td>
+  <td><input type="submit" name="action" value="Add"></input></td>
   </tr>
 </form>
 </table>
@@ -59,7 +95,16 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		return
 	}
-	v := map[string]string{}
+	ns := r.FormValue("ns")
+	if ns != "" {
+		var err error
+		c, err = Namespace(c, ns)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	v := map[string]row{}
 	q := datastore.NewQuery(Kind)
 	for t := q.Run(c); ; {
 		var e e
@@ -71,9 +116,13 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		v[k.StringID()] = e.Value
+		inputType := "text"
+		if b, ok := bindings[k.StringID()]; ok {
+			inputType = b.kind.inputType()
+		}
+		v[k.StringID()] = row{Value: e.Value, Encrypted: e.Encrypted, InputType: inputType, Version: e.Version}
 	}
-	if err := adminTmpl.Execute(w, v); err != nil {
+	if err := adminTmpl.Execute(w, page{NS: ns, Rows: v}); err != nil {
 		c.Warningf("error executing template: %v", err)
 	}
 }
@@ -89,22 +138,71 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deleteKey := r.FormValue("delete_key")
-	if deleteKey != "" {
-		if err := memcache.Delete(c, deleteKey); err != nil && err != memcache.ErrCacheMiss {
-			c.Errorf("error deleting %q from memcache: %v", deleteKey, err)
+	ns := r.FormValue("ns")
+	if ns != "" {
+		var err error
+		c, err = Namespace(c, ns)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := r.FormValue("key")
+	val := r.FormValue("val")
+	if b, ok := bindings[key]; ok && b.kind == kindBool && val == "" {
+		// Unchecked checkboxes aren't submitted at all.
+		val = "false"
+	}
+
+	switch r.FormValue("action") {
+	case "Delete":
+		if err := memcache.Delete(c, key); err != nil && err != memcache.ErrCacheMiss {
+			c.Errorf("error deleting %q from memcache: %v", key, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		k := datastore.NewKey(c, Kind, deleteKey, 0, nil)
+		k := datastore.NewKey(c, Kind, key, 0, nil)
 		if err := datastore.Delete(c, k); err != nil {
-			c.Errorf("error deleting %q from datastore: %v", deleteKey, err)
+			c.Errorf("error deleting %q from datastore: %v", key, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	} else {
-		key := r.FormValue("key")
-		val := r.FormValue("val")
+	case "Save":
+		var existing e
+		if err := datastore.Get(c, datastore.NewKey(c, Kind, key, 0, nil), &existing); err != nil && err != datastore.ErrNoSuchEntity {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if existing.Encrypted {
+			// The admin UI never renders a real value for an encrypted
+			// row, so there's no way to Save one without clobbering it
+			// with an empty string; delete and re-add it instead.
+			http.Error(w, fmt.Sprintf("%q is encrypted and can't be edited in place; delete and re-add it", key), http.StatusBadRequest)
+			return
+		}
+		if b, ok := bindings[key]; ok {
+			if err := b.kind.validate(val); err != nil {
+				http.Error(w, fmt.Sprintf("invalid value for %q: %v", key, err), http.StatusBadRequest)
+				return
+			}
+		}
+		expectedVersion, err := strconv.ParseInt(r.FormValue("expected_version"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid expected_version", http.StatusBadRequest)
+			return
+		}
+		if err := update(c, ns, key, val, expectedVersion); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default: // "Add"
+		if b, ok := bindings[key]; ok {
+			if err := b.kind.validate(val); err != nil {
+				http.Error(w, fmt.Sprintf("invalid value for %q: %v", key, err), http.StatusBadRequest)
+				return
+			}
+		}
 		if err := set(c, key, val); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -112,12 +210,30 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// TODO: remove this hack.
 	time.Sleep(time.Millisecond * 500)
-	http.Redirect(w, r, "/_ah/value/admin", http.StatusSeeOther)
+	redirect := "/_ah/value/admin"
+	if ns != "" {
+		redirect += "?ns=" + url.QueryEscape(ns)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
 func set(c appengine.Context, key string, val string) error {
-	if _, err := memcache.Get(c, key); err != memcache.ErrCacheMiss {
-		return errors.New("key found in memcache")
+	// A negative-cache or load-lock sentinel in memcache doesn't mean the
+	// key already has a real value, so it shouldn't block an Add.
+	if i, err := memcache.Get(c, MemcacheKeyPrefix+key); err == nil {
+		if !isSentinel(i.Value, negativeCache) && !isSentinel(i.Value, loading) {
+			return errors.New("key found in memcache")
+		}
+	} else if err != memcache.ErrCacheMiss {
+		return fmt.Errorf("error checking memcache for %q: %v", key, err)
+	}
+	ent := e{Value: val}
+	if Encryption != nil {
+		ciphertext, err := Encryption.Encrypt([]byte(val))
+		if err != nil {
+			return fmt.Errorf("error encrypting value for %q: %v", key, err)
+		}
+		ent = e{Value: string(ciphertext), Encrypted: true}
 	}
 	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
 		// Fail if the value is already stored.
@@ -131,7 +247,7 @@ func set(c appengine.Context, key string, val string) error {
 		}
 
 		// Put the value in the datastore.
-		_, err := datastore.Put(tc, k, &e{Value: val})
+		_, err := datastore.Put(tc, k, &ent)
 		return err
 	}, nil)
 }
@@ -0,0 +1,239 @@
+// +build appengine
+
+package value
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Cipher encrypts and decrypts value payloads before they are written to, or
+// after they are read from, the datastore. Implementations are responsible
+// for embedding whatever version and nonce information they need in the
+// returned ciphertext, since that's all that's persisted.
+type Cipher interface {
+	Encrypt(plaintext []byte) (ciphertext []byte, err error)
+	Decrypt(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// Encryption, when non-nil, is used by set and GetMulti to transparently
+// encrypt values before they're stored in the datastore, and decrypt them
+// after they're read back. Leave it nil to store values as plain strings,
+// as before.
+var Encryption Cipher
+
+// Keyring is the default Cipher implementation. It encrypts with AES-GCM
+// under its current key, but can decrypt ciphertext produced under any key
+// that's been added to it, which makes key rotation possible: add the new
+// key, call SetCurrent, then use Rotate to re-encrypt existing values.
+//
+// A Keyring is typically assigned to Encryption and used concurrently by
+// every request handling a live app, while AddKey/SetCurrent are called
+// from an operator-triggered rotation; mu guards current and aeads against
+// that concurrent access.
+type Keyring struct {
+	mu      sync.RWMutex
+	current byte
+	aeads   map[byte]cipher.AEAD
+}
+
+// NewKeyring returns an empty Keyring. Use AddKey to populate it with at
+// least one key before using it to Encrypt or Decrypt.
+func NewKeyring() *Keyring {
+	return &Keyring{aeads: map[byte]cipher.AEAD{}}
+}
+
+// AddKey registers key (16, 24, or 32 bytes, for AES-128/192/256) under the
+// given version byte, and makes it the current key used for Encrypt.
+func (k *Keyring) AddKey(version byte, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.aeads[version] = aead
+	k.current = version
+	return nil
+}
+
+// SetCurrent selects which previously-added key version Encrypt should use.
+// It's used during rotation to keep encrypting under the old key until the
+// new one has been added, then switch over.
+func (k *Keyring) SetCurrent(version byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = version
+}
+
+// Encrypt seals plaintext under the current key, prefixing the ciphertext
+// with the key version and a random nonce so it can later be decrypted even
+// after the current key changes.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	aead, ok := k.aeads[k.current]
+	current := k.current
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("value: no key registered for current version %d", current)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, current)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens ciphertext using whichever registered key produced it,
+// identified by the version byte at the start of the ciphertext.
+func (k *Keyring) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 1 {
+		return nil, errors.New("value: ciphertext too short")
+	}
+	k.mu.RLock()
+	aead, ok := k.aeads[ciphertext[0]]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("value: no key registered for version %d", ciphertext[0])
+	}
+	if len(ciphertext) < 1+aead.NonceSize() {
+		return nil, errors.New("value: ciphertext too short")
+	}
+	nonce := ciphertext[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[1+aead.NonceSize():], nil)
+}
+
+// KeySource supplies the raw key material used to build the default
+// Keyring-based Cipher. It's pluggable so key material can come from Cloud
+// KMS in production and an env var in development.
+type KeySource interface {
+	Key(c appengine.Context) (version byte, key []byte, err error)
+}
+
+// EnvKeySource reads a base64-encoded master key from the named environment
+// variable, under key version 1. It's intended for local development and
+// for apps that don't yet have a KMS keyring provisioned.
+type EnvKeySource struct {
+	// Var is the environment variable holding the base64-std-encoded key.
+	Var string
+}
+
+// Key implements KeySource.
+func (e EnvKeySource) Key(c appengine.Context) (byte, []byte, error) {
+	s := os.Getenv(e.Var)
+	if s == "" {
+		return 0, nil, fmt.Errorf("value: env var %q is not set", e.Var)
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return 0, nil, fmt.Errorf("value: decoding %q: %v", e.Var, err)
+	}
+	return 1, key, nil
+}
+
+// KMSKeySource unwraps a data encryption key using a Google Cloud KMS
+// CryptoKey, so the long-lived key never needs to be held in app source or
+// config. WrappedKey is the base64-encoded ciphertext returned by the KMS
+// encrypt API when the DEK was first wrapped.
+type KMSKeySource struct {
+	// CryptoKeyName is the full KMS resource name, e.g.
+	// "projects/my-project/locations/global/keyRings/my-ring/cryptoKeys/my-key".
+	CryptoKeyName string
+	// WrappedKey is the base64-encoded, KMS-encrypted data encryption key.
+	WrappedKey string
+	// Version identifies this key for ciphertexts produced with it.
+	Version byte
+
+	// Decrypt calls the Cloud KMS API to unwrap WrappedKey. It's a field
+	// rather than a hardcoded dependency so tests and callers without a
+	// vendored KMS client can supply their own implementation.
+	Decrypt func(c appengine.Context, cryptoKeyName string, wrapped []byte) ([]byte, error)
+}
+
+// Key implements KeySource.
+func (k KMSKeySource) Key(c appengine.Context) (byte, []byte, error) {
+	if k.Decrypt == nil {
+		return 0, nil, errors.New("value: KMSKeySource.Decrypt is not set")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(k.WrappedKey)
+	if err != nil {
+		return 0, nil, fmt.Errorf("value: decoding wrapped key: %v", err)
+	}
+	key, err := k.Decrypt(c, k.CryptoKeyName, wrapped)
+	if err != nil {
+		return 0, nil, fmt.Errorf("value: unwrapping key via KMS: %v", err)
+	}
+	return k.Version, key, nil
+}
+
+// LoadKeyring builds a Keyring by pulling key material from src and
+// registering it as the keyring's current key. The result is typically
+// assigned to Encryption during app init.
+func LoadKeyring(c appengine.Context, src KeySource) (*Keyring, error) {
+	version, key, err := src.Key(c)
+	if err != nil {
+		return nil, err
+	}
+	k := NewKeyring()
+	if err := k.AddKey(version, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate re-encrypts every stored value, decrypting each with oldCipher and
+// re-encrypting with newCipher inside its own transaction, then busts the
+// corresponding memcache entry. Use it after adding a new key to a Keyring
+// and calling SetCurrent, passing the same Keyring as both arguments.
+func Rotate(c appengine.Context, oldCipher, newCipher Cipher) error {
+	keys, err := datastore.NewQuery(Kind).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("value: listing keys to rotate: %v", err)
+	}
+	for _, k := range keys {
+		err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			var ent e
+			if err := datastore.Get(tc, k, &ent); err != nil {
+				return err
+			}
+			if !ent.Encrypted {
+				return nil
+			}
+			plain, err := oldCipher.Decrypt([]byte(ent.Value))
+			if err != nil {
+				return err
+			}
+			ciphertext, err := newCipher.Encrypt(plain)
+			if err != nil {
+				return err
+			}
+			ent.Value = string(ciphertext)
+			_, err = datastore.Put(tc, k, &ent)
+			return err
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("value: rotating %q: %v", k.StringID(), err)
+		}
+		if err := memcache.Delete(c, MemcacheKeyPrefix+k.StringID()); err != nil && err != memcache.ErrCacheMiss {
+			c.Errorf("error busting memcache for %q after rotation: %v", k.StringID(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// +build appengine
+
+package value
+
+import "testing"
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	ciphertext, err := k.Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if string(ciphertext) == "hunter2" {
+		t.Fatalf("Encrypt returned plaintext unchanged")
+	}
+	plain, err := k.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if string(plain) != "hunter2" {
+		t.Fatalf("got %q, want %q", plain, "hunter2")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("AddKey(1): %v", err)
+	}
+	old, err := k.Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Encrypt under key 1: %v", err)
+	}
+
+	if err := k.AddKey(2, []byte("fedcba9876543210")); err != nil {
+		t.Fatalf("AddKey(2): %v", err)
+	}
+
+	// Ciphertext produced under the old key should still decrypt.
+	plain, err := k.Decrypt(old)
+	if err != nil {
+		t.Fatalf("Decrypt old ciphertext after rotation: %v", err)
+	}
+	if string(plain) != "hunter2" {
+		t.Fatalf("got %q, want %q", plain, "hunter2")
+	}
+
+	// New encryptions should use the new current key.
+	next, err := k.Encrypt([]byte("hunter3"))
+	if err != nil {
+		t.Fatalf("Encrypt under key 2: %v", err)
+	}
+	if next[0] != 2 {
+		t.Fatalf("ciphertext version byte = %d, want 2", next[0])
+	}
+}
+
+func TestKeyringDecryptUnknownVersion(t *testing.T) {
+	k := NewKeyring()
+	if err := k.AddKey(1, []byte("0123456789abcdef")); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	if _, err := k.Decrypt([]byte{9, 1, 2, 3}); err == nil {
+		t.Fatalf("Decrypt with unknown key version succeeded, want error")
+	}
+}
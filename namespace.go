@@ -0,0 +1,20 @@
+// +build appengine
+
+package value
+
+import (
+	"appengine"
+)
+
+// Namespace returns a copy of c scoped to the given namespace, using App
+// Engine's built-in namespaces API. Datastore keys and queries, and
+// memcache entries, made with the returned context are automatically
+// partitioned from other namespaces, so a single app can store per-tenant
+// secrets or per-environment feature flags under the same keys without
+// collisions.
+//
+// Pass the result to Get, GetMulti, Update, or Init in place of the
+// request's own context to operate within that namespace.
+func Namespace(c appengine.Context, ns string) (appengine.Context, error) {
+	return appengine.Namespace(c, ns)
+}
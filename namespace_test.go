@@ -0,0 +1,61 @@
+// +build appengine
+
+package value
+
+import (
+	"testing"
+
+	"appengine/aetest"
+)
+
+// TestNamespaceScoping verifies that values stored in one namespace aren't
+// visible from another, or from the default (unnamespaced) context.
+func TestNamespaceScoping(t *testing.T) {
+	c, done, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("aetest.NewContext: %v", err)
+	}
+	defer done()
+
+	const key = "namespaced-key"
+
+	ca, err := Namespace(c, "tenant-a")
+	if err != nil {
+		t.Fatalf("Namespace(tenant-a): %v", err)
+	}
+	if err := set(ca, key, "a-value"); err != nil {
+		t.Fatalf("set in tenant-a: %v", err)
+	}
+
+	if got := Get(ca, key); got != "a-value" {
+		t.Fatalf("Get(tenant-a, %q) = %q, want %q", key, got, "a-value")
+	}
+
+	cb, err := Namespace(c, "tenant-b")
+	if err != nil {
+		t.Fatalf("Namespace(tenant-b): %v", err)
+	}
+	if got := Get(cb, key); got != "" {
+		t.Fatalf("Get(tenant-b, %q) = %q, want empty (no cross-tenant leak)", key, got)
+	}
+
+	if got := Get(c, key); got != "" {
+		t.Fatalf("Get(default, %q) = %q, want empty (no leak from a namespace)", key, got)
+	}
+}
+
+// TestNSKeyRoundTrip exercises nsKey/splitNSKey, which is how watchers and
+// versions stay scoped per-namespace.
+func TestNSKeyRoundTrip(t *testing.T) {
+	tests := []struct{ ns, key string }{
+		{"", "plain-key"},
+		{"tenant-a", "shared-key"},
+		{"tenant-b", "shared-key"},
+	}
+	for _, tt := range tests {
+		gotNS, gotKey := splitNSKey(nsKey(tt.ns, tt.key))
+		if gotNS != tt.ns || gotKey != tt.key {
+			t.Errorf("splitNSKey(nsKey(%q, %q)) = (%q, %q), want (%q, %q)", tt.ns, tt.key, gotNS, gotKey, tt.ns, tt.key)
+		}
+	}
+}
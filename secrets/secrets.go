@@ -9,14 +9,18 @@
 // across many requests are should be quick to look up, but shouldn't be stored
 // in source control as consts.
 //
-// Values are not encrypted or obfuscated, and will be easily visible to any
-// other app admin.
+// Values are not encrypted or obfuscated by default, and will be easily
+// visible to any other app admin. Set Encryption to a value.Cipher to have
+// secrets transparently encrypted before they're written to the datastore,
+// and decrypted after they're read back.
 package secrets
 
 import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
+
+	"github.com/ImJasonH/appengine-value"
 )
 
 // Entity name used to store secrets in the datastore.
@@ -25,6 +29,11 @@ var EntityName = "Secrets"
 // Prefix to use when storing secrets in memcache.
 var MemcacheKeyPrefix = ""
 
+// Encryption, when non-nil, is used to decrypt secrets read from the
+// datastore that were stored with Encrypted set. It's typically the same
+// Cipher assigned to value.Encryption.
+var Encryption value.Cipher
+
 var local = map[string]string{}
 
 // Get returns the secret value associated with the key.
@@ -50,23 +59,38 @@ func Get(c appengine.Context, key string) string {
 	// Get secret from datastore if missing from memcache.
 	k := datastore.NewKey(c, EntityName, key, 0, nil)
 	var e struct {
-		Value string `datastore:"-"`
+		Value     string `datastore:",noindex"`
+		Encrypted bool   `datastore:",noindex"`
 	}
 	if err := datastore.Get(c, k, &e); err != nil {
 		c.Errorf("error getting %q from datastore: %v", key, err)
 		return ""
 	}
 
+	val := e.Value
+	if e.Encrypted {
+		if Encryption == nil {
+			c.Errorf("secret %q is encrypted but no Encryption cipher is configured", key)
+			return ""
+		}
+		plain, err := Encryption.Decrypt([]byte(e.Value))
+		if err != nil {
+			c.Errorf("error decrypting %q: %v", key, err)
+			return ""
+		}
+		val = string(plain)
+	}
+
 	// Store secret in instance memory for next time.
-	local[key] = e.Value
+	local[key] = val
 
 	// Store secret in memcache for next time.
 	if err := memcache.Set(c, &memcache.Item{
 		Key:   MemcacheKeyPrefix + key,
-		Value: []byte(e.Value),
+		Value: []byte(val),
 	}); err != nil {
 		c.Errorf("error setting %q in memcache: %v", key, err)
 	}
 
-	return e.Value
+	return val
 }
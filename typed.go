@@ -0,0 +1,222 @@
+// +build appengine
+
+package value
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"appengine"
+)
+
+// kind identifies the type of a registered value, used to choose the admin
+// UI's <input type> and to validate updates before they're stored.
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindBool
+	kindDuration
+	kindJSON
+)
+
+// inputType is the HTML input type= attribute the admin UI should use for a
+// value of this kind.
+func (k kind) inputType() string {
+	switch k {
+	case kindInt:
+		return "number"
+	case kindBool:
+		return "checkbox"
+	default:
+		return "text"
+	}
+}
+
+// validate reports whether raw can be parsed as k, without applying it to
+// any bound variable.
+func (k kind) validate(raw string) error {
+	switch k {
+	case kindInt:
+		_, err := strconv.ParseInt(raw, 10, 64)
+		return err
+	case kindBool:
+		_, err := strconv.ParseBool(raw)
+		return err
+	case kindDuration:
+		_, err := time.ParseDuration(raw)
+		return err
+	case kindJSON:
+		return json.Unmarshal([]byte(raw), new(interface{}))
+	default:
+		return nil
+	}
+}
+
+// binding connects a registered key to the kind of value it holds and the
+// logic that applies a parsed stored string to the caller's variable.
+type binding struct {
+	kind kind
+	// apply parses raw and stores it in the bound variable. Callers should
+	// only invoke it after kind.validate(raw) has already succeeded.
+	apply func(raw string) error
+}
+
+var bindings = map[string]binding{}
+
+// String defines a string value with specified name.
+// The return value is the address of a string variable that stores the value when Init is called.
+func String(key string) *string {
+	p := new(string)
+	StringVar(p, key)
+	return p
+}
+
+// StringVar defines a string value with specified name.
+// The argument p points to a string variable in which to store the value when Init is called.
+func StringVar(p *string, key string) {
+	bindings[key] = binding{
+		kind: kindString,
+		apply: func(raw string) error {
+			*p = raw
+			return nil
+		},
+	}
+}
+
+// Int defines an int64 value with the specified name.
+// The return value is the address of an int64 variable that stores the
+// value when Init is called. If the stored value is missing or fails to
+// parse as an int64, p is left at whatever value it already holds, so
+// callers can set a default before Init runs.
+func Int(key string) *int64 {
+	p := new(int64)
+	IntVar(p, key)
+	return p
+}
+
+// IntVar defines an int64 value with the specified name.
+// The argument p points to an int64 variable in which to store the value
+// when Init is called.
+func IntVar(p *int64, key string) {
+	bindings[key] = binding{
+		kind: kindInt,
+		apply: func(raw string) error {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+// Bool defines a bool value with the specified name.
+// The return value is the address of a bool variable that stores the value
+// when Init is called. If the stored value is missing or fails to parse as
+// a bool, p is left at whatever value it already holds, so callers can set
+// a default before Init runs.
+func Bool(key string) *bool {
+	p := new(bool)
+	BoolVar(p, key)
+	return p
+}
+
+// BoolVar defines a bool value with the specified name.
+// The argument p points to a bool variable in which to store the value
+// when Init is called.
+func BoolVar(p *bool, key string) {
+	bindings[key] = binding{
+		kind: kindBool,
+		apply: func(raw string) error {
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return err
+			}
+			*p = b
+			return nil
+		},
+	}
+}
+
+// Duration defines a time.Duration value with the specified name, stored
+// and parsed using time.Duration's text format (e.g. "5m30s").
+// The return value is the address of a time.Duration variable that stores
+// the value when Init is called. If the stored value is missing or fails
+// to parse, p is left at whatever value it already holds, so callers can
+// set a default before Init runs.
+func Duration(key string) *time.Duration {
+	p := new(time.Duration)
+	DurationVar(p, key)
+	return p
+}
+
+// DurationVar defines a time.Duration value with the specified name.
+// The argument p points to a time.Duration variable in which to store the
+// value when Init is called.
+func DurationVar(p *time.Duration, key string) {
+	bindings[key] = binding{
+		kind: kindDuration,
+		apply: func(raw string) error {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return err
+			}
+			*p = d
+			return nil
+		},
+	}
+}
+
+// JSONVar defines a value with the specified name whose stored string is
+// unmarshaled as JSON into p, which should be a non-nil pointer. If the
+// stored value is missing or fails to unmarshal, p is left at whatever
+// value it already holds, so callers can set a default before Init runs.
+func JSONVar(p interface{}, key string) {
+	bindings[key] = binding{
+		kind: kindJSON,
+		apply: func(raw string) error {
+			return json.Unmarshal([]byte(raw), p)
+		},
+	}
+}
+
+// Init populates values defined using String, StringVar, Int, IntVar, Bool,
+// BoolVar, Duration, DurationVar, or JSONVar.
+// Must be called after all values are defined and before values are
+// accessed by the program. An optional namespace scopes the lookup to
+// that namespace, as with Namespace.
+func Init(c appengine.Context, ns ...string) error {
+	var namespace string
+	if len(ns) > 0 {
+		namespace = ns[0]
+		var err error
+		c, err = Namespace(c, namespace)
+		if err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(bindings))
+	for k := range bindings {
+		keys = append(keys, k)
+	}
+	m := getMulti(c, namespace, keys...)
+	for k, raw := range m {
+		if raw == "" {
+			// Not configured; leave the bound variable at its default.
+			continue
+		}
+		b := bindings[k]
+		if err := b.kind.validate(raw); err != nil {
+			c.Errorf("error parsing value for %q: %v", k, err)
+			continue
+		}
+		if err := b.apply(raw); err != nil {
+			c.Errorf("error applying value for %q: %v", k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// +build appengine
+
+package value
+
+import "testing"
+
+func TestKindInputType(t *testing.T) {
+	tests := []struct {
+		k    kind
+		want string
+	}{
+		{kindString, "text"},
+		{kindInt, "number"},
+		{kindBool, "checkbox"},
+		{kindDuration, "text"},
+		{kindJSON, "text"},
+	}
+	for _, tt := range tests {
+		if got := tt.k.inputType(); got != tt.want {
+			t.Errorf("kind(%d).inputType() = %q, want %q", tt.k, got, tt.want)
+		}
+	}
+}
+
+func TestKindValidate(t *testing.T) {
+	tests := []struct {
+		k       kind
+		raw     string
+		wantErr bool
+	}{
+		{kindString, "anything", false},
+		{kindInt, "42", false},
+		{kindInt, "not-a-number", true},
+		{kindBool, "true", false},
+		{kindBool, "not-a-bool", true},
+		{kindDuration, "5m30s", false},
+		{kindDuration, "not-a-duration", true},
+		{kindJSON, `{"a":1}`, false},
+		{kindJSON, "not-json", true},
+	}
+	for _, tt := range tests {
+		err := tt.k.validate(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("kind(%d).validate(%q) = %v, wantErr %v", tt.k, tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIntVarApply(t *testing.T) {
+	var n int64 = 7
+	IntVar(&n, "typed-test-int")
+	b := bindings["typed-test-int"]
+	if err := b.apply("99"); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if n != 99 {
+		t.Fatalf("n = %d, want 99", n)
+	}
+}
+
+func TestBoolVarApply(t *testing.T) {
+	var v bool
+	BoolVar(&v, "typed-test-bool")
+	b := bindings["typed-test-bool"]
+	if err := b.apply("true"); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !v {
+		t.Fatalf("v = %v, want true", v)
+	}
+}
+
+func TestJSONVarApply(t *testing.T) {
+	var dst struct{ A int }
+	JSONVar(&dst, "typed-test-json")
+	b := bindings["typed-test-json"]
+	if err := b.apply(`{"A":5}`); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if dst.A != 5 {
+		t.Fatalf("dst.A = %d, want 5", dst.A)
+	}
+}
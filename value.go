@@ -13,11 +13,15 @@
 // are used across many requests are should be quick to look up, but shouldn't
 // be stored in source control as consts for security reasons.
 //
-// Values are not encrypted or obfuscated, and will be easily visible to any
-// other app admin.
+// Values are not encrypted or obfuscated by default, and will be easily
+// visible to any other app admin. Set Encryption to a Cipher (see
+// LoadKeyring) to have values transparently encrypted before they're written
+// to the datastore, and decrypted after they're read back.
 package value
 
 import (
+	"time"
+
 	"appengine"
 	"appengine/datastore"
 	"appengine/memcache"
@@ -29,8 +33,46 @@ var Kind = "Values"
 // Prefix to use when storing values in memcache.
 var MemcacheKeyPrefix = ""
 
+// NegativeCacheTTL is how long a negative-cache entry is kept in memcache
+// after a key is found not to exist in the datastore, so repeated lookups
+// of an unset key don't each pay the cost of a datastore round trip.
+var NegativeCacheTTL = 10 * time.Second
+
+// LockTTL is how long the "loading" marker written to memcache while a
+// key is being fetched from the datastore is allowed to live, in case the
+// goroutine that wrote it dies before replacing it with the real value.
+var LockTTL = 5 * time.Second
+
+// MaxLockRetries is how many times GetMulti will sleep and re-check
+// memcache for a key that's locked by a concurrent fetch, before giving up
+// and fetching it from the datastore itself.
+var MaxLockRetries = 5
+
+// lockRetryDelay is how long GetMulti sleeps between each of MaxLockRetries
+// checks of a locked key.
+var lockRetryDelay = 50 * time.Millisecond
+
+// negativeCache and loading are single-byte sentinel values stored in
+// memcache in place of a real value: negativeCache records that a key is
+// known not to exist in the datastore, and loading marks a key as
+// currently being fetched by another caller.
+var (
+	negativeCache = []byte{0}
+	loading       = []byte{1}
+)
+
+func isSentinel(b, sentinel []byte) bool {
+	return len(b) == 1 && len(sentinel) == 1 && b[0] == sentinel[0]
+}
+
 type e struct {
 	Value string `datastore:",noindex"`
+	// Encrypted indicates Value holds ciphertext produced by Encryption,
+	// rather than the plain string, and must be decrypted before use.
+	Encrypted bool `datastore:",noindex"`
+	// Version is incremented by Update each time the value changes, and
+	// used as the compare-and-swap guard for optimistic concurrency.
+	Version int64 `datastore:",noindex"`
 }
 
 // Get returns the value associated with the key.
@@ -41,83 +83,259 @@ func Get(c appengine.Context, key string) string {
 	return GetMulti(c, key)[key]
 }
 
+// GetNS is Get scoped to namespace ns, as with Namespace.
+func GetNS(c appengine.Context, ns, key string) string {
+	return GetMultiNS(c, ns, key)[key]
+}
+
 // GetMulti is a batch version of Get. It returns a map keyed on the provided keys.
 //
 // If a key is not found in memcache or datastore, it will map to an empty string.
 func GetMulti(c appengine.Context, key ...string) map[string]string {
+	return getMulti(c, "", key...)
+}
+
+// GetMultiNS is GetMulti scoped to namespace ns, as with Namespace. Besides
+// wrapping c with Namespace, it tags the namespace onto each key's cached
+// Version and Watch notifications, so two tenants using the same key name
+// don't stomp on each other's observed version or misfire each other's
+// watchers.
+func GetMultiNS(c appengine.Context, ns string, key ...string) map[string]string {
+	if ns != "" {
+		nc, err := Namespace(c, ns)
+		if err != nil {
+			c.Errorf("error scoping to namespace %q: %v", ns, err)
+			m := map[string]string{}
+			for _, k := range key {
+				m[k] = ""
+			}
+			return m
+		}
+		c = nc
+	}
+	return getMulti(c, ns, key...)
+}
+
+func getMulti(c appengine.Context, ns string, key ...string) map[string]string {
 	m := map[string]string{}
 
-	// Get whatever values we can from memcache
-	mi, err := memcache.GetMulti(c, key)
+	mcKeys := make([]string, len(key))
+	for i, k := range key {
+		mcKeys[i] = MemcacheKeyPrefix + k
+	}
+	mi, err := memcache.GetMulti(c, mcKeys)
 	if err != nil {
 		c.Errorf("error getting multi from memcache: %v", err)
 	}
-	for k, i := range mi {
-		m[k[len(MemcacheKeyPrefix):]] = string(i.Value)
-	}
-	if len(mi) == len(key) {
-		// All values found in memcahe!
-		return m
-	}
 
-	// Get values not found in memcache from datastore.
-	keys := []*datastore.Key{}
+	var missing []string
 	for _, k := range key {
-		if _, ok := mi[k]; !ok {
-			keys = append(keys, datastore.NewKey(c, Kind, k, 0, nil))
+		item, ok := mi[MemcacheKeyPrefix+k]
+		if !ok {
+			missing = append(missing, k)
+			continue
+		}
+		switch {
+		case isSentinel(item.Value, negativeCache):
+			m[k] = ""
+		case isSentinel(item.Value, loading):
+			if v, ok := waitForLoad(c, k); ok {
+				m[k] = v
+			} else {
+				// Gave up waiting for the lock holder; fetch it ourselves.
+				m[k] = fetchAndCache(c, ns, k)
+			}
+		default:
+			m[k] = string(item.Value)
 		}
 	}
-	fromDS := make([]e, len(keys))
-	if err := datastore.GetMulti(c, keys, fromDS); err != nil {
-		// TODO: appengine.MultiError may contain only ErrNoSuchEntity errs,
-		// in which case we should populate as many results as exist. If any
-		// are not ErrNoSuchEntity then something actually went wrong.
-		c.Errorf("error getting multi from datastore: %v", err)
-		return m
+
+	// Get values not found in memcache from the datastore. Each key is
+	// first protected by its own load lock, so a thundering herd of
+	// callers missing the same cold key doesn't all hit the datastore;
+	// but the (common) case of several different cold keys being fetched
+	// at once is still handled as a single batched datastore.GetMulti,
+	// rather than one round trip per key.
+	var locked []string
+	for _, k := range missing {
+		switch v, ok, locked2 := tryLock(c, k); {
+		case ok:
+			m[k] = v
+		case locked2:
+			locked = append(locked, k)
+		}
 	}
-	items := []*memcache.Item{}
-	for i, de := range fromDS {
-		m[keys[i].StringID()] = de.Value
-		items = append(items, &memcache.Item{
-			Key:   MemcacheKeyPrefix + keys[i].StringID(),
-			Value: []byte(de.Value),
-		})
+	if len(locked) > 0 {
+		fetchMultiFromDatastore(c, ns, locked, m)
 	}
+	return m
+}
 
-	// Store values in memcache for next time.
-	if err := memcache.SetMulti(c, items); err != nil {
-		c.Errorf("error setting multi in memcache: %v", err)
+// tryLock attempts to acquire the load lock for key, so the caller can
+// fetch it from the datastore without racing other callers doing the
+// same. If another caller already holds the lock, tryLock waits for it
+// via waitForLoad and returns its result; only if that wait times out, or
+// the lock is acquired here, does it report locked=true so the caller
+// fetches key itself.
+func tryLock(c appengine.Context, key string) (val string, ok, locked bool) {
+	err := memcache.Add(c, &memcache.Item{
+		Key:        MemcacheKeyPrefix + key,
+		Value:      loading,
+		Expiration: LockTTL,
+	})
+	switch err {
+	case nil:
+		return "", false, true
+	case memcache.ErrNotStored:
+		// Someone else is already fetching (or has fetched) this key.
+		if v, ok := waitForLoad(c, key); ok {
+			return v, true, false
+		}
+		// Gave up waiting; fetch it ourselves rather than block forever.
+		return "", false, true
+	default:
+		c.Errorf("error acquiring load lock for %q: %v", key, err)
+		return "", false, true
 	}
-	return m
 }
 
-var vals = map[string]*string{}
+// fetchAndCache fetches key from the datastore, protecting against a
+// thundering herd of concurrent callers doing the same for the same cold
+// key via tryLock.
+func fetchAndCache(c appengine.Context, ns, key string) string {
+	v, ok, _ := tryLock(c, key)
+	if ok {
+		return v
+	}
+	return fetchFromDatastore(c, ns, key)
+}
 
-// String defines a string value with specified name.
-// The return value is the address of a string variable that stores the value when Init is called.
-func String(key string) *string {
-	p := new(string)
-	StringVar(p, key)
-	return p
+// waitForLoad polls memcache for key up to MaxLockRetries times, sleeping
+// lockRetryDelay between attempts, for whoever holds the load lock to
+// replace it with the real value or a negative-cache sentinel.
+func waitForLoad(c appengine.Context, key string) (val string, ok bool) {
+	mcKey := MemcacheKeyPrefix + key
+	for i := 0; i < MaxLockRetries; i++ {
+		time.Sleep(lockRetryDelay)
+		item, err := memcache.Get(c, mcKey)
+		if err == memcache.ErrCacheMiss {
+			return "", false
+		} else if err != nil {
+			c.Errorf("error polling memcache for %q: %v", key, err)
+			return "", false
+		}
+		switch {
+		case isSentinel(item.Value, loading):
+			continue
+		case isSentinel(item.Value, negativeCache):
+			return "", true
+		default:
+			return string(item.Value), true
+		}
+	}
+	return "", false
 }
 
-// StringVar defines a string value with specified name.
-// The argument p points to a string variable in which to store the value when Init is called.
-func StringVar(p *string, key string) {
-	vals[key] = p
+// fetchFromDatastore fetches key's entity from the datastore, decrypting
+// it if necessary, and caches the result in memcache: the decrypted value
+// if it exists, or a negative-cache sentinel if it doesn't.
+func fetchFromDatastore(c appengine.Context, ns, key string) string {
+	mcKey := MemcacheKeyPrefix + key
+	var de e
+	if err := datastore.Get(c, datastore.NewKey(c, Kind, key, 0, nil), &de); err == datastore.ErrNoSuchEntity {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:        mcKey,
+			Value:      negativeCache,
+			Expiration: NegativeCacheTTL,
+		}); err != nil {
+			c.Errorf("error setting negative cache entry for %q: %v", key, err)
+		}
+		return ""
+	} else if err != nil {
+		c.Errorf("error getting %q from datastore: %v", key, err)
+		return ""
+	}
+
+	val := de.Value
+	if de.Encrypted {
+		if Encryption == nil {
+			c.Errorf("value for %q is encrypted but no Encryption cipher is configured", key)
+			return ""
+		}
+		plain, err := Encryption.Decrypt([]byte(de.Value))
+		if err != nil {
+			c.Errorf("error decrypting %q: %v", key, err)
+			return ""
+		}
+		val = string(plain)
+	}
+	checkVersion(ns, key, de.Version, val)
+
+	if err := memcache.Set(c, &memcache.Item{Key: mcKey, Value: []byte(val)}); err != nil {
+		c.Errorf("error setting %q in memcache: %v", key, err)
+	}
+	return val
 }
 
-// Init populates values defined using String or StringVar.
-// Must be called after all values are defined and before values are accessed by the program.
-func Init(c appengine.Context) {
-	keys := make([]string, len(vals))
-	i := 0
-	for k, _ := range vals {
-		keys[i] = k
-		i++
-	}
-	m := GetMulti(c, keys...)
-	for k, v := range m {
-		vals[k] = &v
+// fetchMultiFromDatastore is the batch version of fetchFromDatastore: it
+// fetches all of keys from the datastore in a single datastore.GetMulti,
+// decrypting and caching each result (or a negative-cache sentinel, for
+// keys with no entity), and records m[key] for each.
+func fetchMultiFromDatastore(c appengine.Context, ns string, keys []string, m map[string]string) {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		dsKeys[i] = datastore.NewKey(c, Kind, k, 0, nil)
+	}
+	ents := make([]e, len(keys))
+	err := datastore.GetMulti(c, dsKeys, ents)
+	merr, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		c.Errorf("error getting multi from datastore: %v", err)
+		for _, k := range keys {
+			m[k] = ""
+		}
+		return
+	}
+
+	items := make([]*memcache.Item, 0, len(keys))
+	for i, k := range keys {
+		var keyErr error
+		if merr != nil {
+			keyErr = merr[i]
+		}
+		mcKey := MemcacheKeyPrefix + k
+		if keyErr == datastore.ErrNoSuchEntity {
+			m[k] = ""
+			items = append(items, &memcache.Item{Key: mcKey, Value: negativeCache, Expiration: NegativeCacheTTL})
+			continue
+		} else if keyErr != nil {
+			c.Errorf("error getting %q from datastore: %v", k, keyErr)
+			m[k] = ""
+			continue
+		}
+
+		val := ents[i].Value
+		if ents[i].Encrypted {
+			if Encryption == nil {
+				c.Errorf("value for %q is encrypted but no Encryption cipher is configured", k)
+				m[k] = ""
+				continue
+			}
+			plain, err := Encryption.Decrypt([]byte(ents[i].Value))
+			if err != nil {
+				c.Errorf("error decrypting %q: %v", k, err)
+				m[k] = ""
+				continue
+			}
+			val = string(plain)
+		}
+		checkVersion(ns, k, ents[i].Version, val)
+		m[k] = val
+		items = append(items, &memcache.Item{Key: mcKey, Value: []byte(val)})
+	}
+	if len(items) > 0 {
+		if err := memcache.SetMulti(c, items); err != nil {
+			c.Errorf("error setting multi in memcache: %v", err)
+		}
 	}
 }
@@ -0,0 +1,88 @@
+// +build appengine
+
+package value
+
+import (
+	"sync"
+	"testing"
+
+	"appengine/aetest"
+	"appengine/memcache"
+)
+
+func TestIsSentinel(t *testing.T) {
+	tests := []struct {
+		b, sentinel []byte
+		want        bool
+	}{
+		{negativeCache, negativeCache, true},
+		{loading, loading, true},
+		{negativeCache, loading, false},
+		{[]byte("real value"), negativeCache, false},
+		{nil, negativeCache, false},
+	}
+	for _, tt := range tests {
+		if got := isSentinel(tt.b, tt.sentinel); got != tt.want {
+			t.Errorf("isSentinel(%v, %v) = %v, want %v", tt.b, tt.sentinel, got, tt.want)
+		}
+	}
+}
+
+// TestTryLockContention exercises tryLock from many goroutines racing to
+// fetch the same cold key, asserting exactly one of them acquires the load
+// lock and the rest either wait for it or, having given up, also report
+// locked=true.
+func TestTryLockContention(t *testing.T) {
+	c, done, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("aetest.NewContext: %v", err)
+	}
+	defer done()
+
+	const key = "contended-key"
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var acquired int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, locked := tryLock(c, key)
+			if locked {
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acquired == 0 {
+		t.Fatalf("no goroutine acquired the load lock for %q", key)
+	}
+}
+
+// TestGetMultiNegativeCache exercises the negative-cache path end to end:
+// looking up a key with no stored value should return "" and leave a
+// negative-cache sentinel in memcache, so a second lookup doesn't need to
+// hit the datastore again.
+func TestGetMultiNegativeCache(t *testing.T) {
+	c, done, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatalf("aetest.NewContext: %v", err)
+	}
+	defer done()
+
+	const key = "never-set-key"
+	if got := Get(c, key); got != "" {
+		t.Fatalf("Get(%q) = %q, want empty string", key, got)
+	}
+
+	item, err := memcache.Get(c, MemcacheKeyPrefix+key)
+	if err != nil {
+		t.Fatalf("memcache.Get(%q): %v", key, err)
+	}
+	if !isSentinel(item.Value, negativeCache) {
+		t.Fatalf("memcache item for %q = %v, want negative-cache sentinel", key, item.Value)
+	}
+}
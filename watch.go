@@ -0,0 +1,216 @@
+// +build appengine
+
+package value
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func init() {
+	http.HandleFunc("/_ah/value/refresh", refreshHandler)
+}
+
+// ErrVersionMismatch is returned by Update when expectedVersion doesn't
+// match the Version currently stored for key.
+var ErrVersionMismatch = errors.New("value: version mismatch")
+
+// mu guards versions and watchers, which (unlike bindings, which is only
+// populated during startup) are read and written on every live request.
+var mu sync.Mutex
+
+// versions tracks the most recently observed Version for each key, as seen
+// by GetMulti, Init, or refreshHandler, so changes can be detected without
+// a redeploy. It's keyed by nsKey(ns, key), so the same key name in
+// different namespaces is tracked independently. Guarded by mu.
+var versions = map[string]int64{}
+
+// watchers holds the callbacks registered with Watch, keyed by
+// nsKey(ns, key). Guarded by mu.
+var watchers = map[string][]func(string){}
+
+// nsKey combines a namespace and a key into the string versions and
+// watchers are keyed by, so the same key name in different namespaces
+// doesn't collide.
+func nsKey(ns, key string) string {
+	return ns + "\x00" + key
+}
+
+// splitNSKey is the inverse of nsKey.
+func splitNSKey(k string) (ns, key string) {
+	i := strings.IndexByte(k, 0)
+	return k[:i], k[i+1:]
+}
+
+// Watch registers cb to be called with a key's new value whenever a change
+// to it is observed, either by Update, by the /_ah/value/refresh cron
+// endpoint, or by GetMulti noticing a newer Version in the datastore than
+// it last saw. Watch is meant to be called once per key at startup,
+// alongside String, Int, and the like.
+func Watch(key string, cb func(newVal string)) {
+	WatchNS("", key, cb)
+}
+
+// WatchNS is Watch scoped to namespace ns, as with Namespace.
+func WatchNS(ns, key string, cb func(newVal string)) {
+	mu.Lock()
+	defer mu.Unlock()
+	k := nsKey(ns, key)
+	watchers[k] = append(watchers[k], cb)
+}
+
+// Update stores val for key, succeeding only if the value's current
+// Version in the datastore equals expectedVersion, and returning
+// ErrVersionMismatch otherwise. On success the stored Version is
+// incremented, the memcache entry for key is busted, and any callbacks
+// registered with Watch for key are invoked with val.
+func Update(c appengine.Context, key, val string, expectedVersion int64) error {
+	return UpdateNS(c, "", key, val, expectedVersion)
+}
+
+// UpdateNS is Update scoped to namespace ns, as with Namespace.
+func UpdateNS(c appengine.Context, ns, key, val string, expectedVersion int64) error {
+	if ns != "" {
+		nc, err := Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		c = nc
+	}
+	return update(c, ns, key, val, expectedVersion)
+}
+
+// update is Update's implementation, assuming c has already been scoped to
+// ns (if any), as UpdateNS does.
+func update(c appengine.Context, ns, key, val string, expectedVersion int64) error {
+	var newVersion int64
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		k := datastore.NewKey(tc, Kind, key, 0, nil)
+		var ent e
+		if err := datastore.Get(tc, k, &ent); err != nil {
+			return err
+		}
+		if ent.Version != expectedVersion {
+			return ErrVersionMismatch
+		}
+		ent.Value, ent.Encrypted = val, false
+		if Encryption != nil {
+			ciphertext, err := Encryption.Encrypt([]byte(val))
+			if err != nil {
+				return err
+			}
+			ent.Value, ent.Encrypted = string(ciphertext), true
+		}
+		ent.Version++
+		newVersion = ent.Version
+		_, err := datastore.Put(tc, k, &ent)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := memcache.Delete(c, MemcacheKeyPrefix+key); err != nil && err != memcache.ErrCacheMiss {
+		c.Errorf("error busting memcache for %q: %v", key, err)
+	}
+	mu.Lock()
+	versions[nsKey(ns, key)] = newVersion
+	mu.Unlock()
+	notify(ns, key, val)
+	return nil
+}
+
+// checkVersion records the Version observed for key in namespace ns, and
+// if it's newer than the last one seen on this instance, notifies any
+// watchers with the decrypted value.
+func checkVersion(ns, key string, version int64, val string) {
+	mu.Lock()
+	k := nsKey(ns, key)
+	newer := version > versions[k]
+	if newer {
+		versions[k] = version
+	}
+	mu.Unlock()
+	if newer {
+		notify(ns, key, val)
+	}
+}
+
+// notify invokes the callbacks registered for key in namespace ns with
+// val. It copies the callback slice out from under mu before invoking
+// them, so a callback that calls Watch (or triggers another notify)
+// doesn't deadlock.
+func notify(ns, key, val string) {
+	mu.Lock()
+	cbs := append([]func(string){}, watchers[nsKey(ns, key)]...)
+	mu.Unlock()
+	for _, cb := range cbs {
+		cb(val)
+	}
+}
+
+// refreshHandler re-fetches every watched key directly from the
+// datastore, bypassing memcache, and notifies watchers of any keys whose
+// Version has advanced since it was last observed on this instance. Map
+// app.yaml's cron.yaml to POST /_ah/value/refresh periodically to pick up
+// changes in long-lived handlers without a redeploy.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	mu.Lock()
+	byNS := map[string][]string{}
+	for nk := range watchers {
+		ns, key := splitNSKey(nk)
+		byNS[ns] = append(byNS[ns], key)
+	}
+	mu.Unlock()
+
+	for ns, keys := range byNS {
+		nc := c
+		if ns != "" {
+			var err error
+			nc, err = Namespace(c, ns)
+			if err != nil {
+				c.Errorf("error scoping to namespace %q: %v", ns, err)
+				continue
+			}
+		}
+		refreshNS(nc, ns, keys)
+	}
+}
+
+// refreshNS re-fetches keys, all watched within namespace ns, from the
+// datastore using c (already scoped to ns), and checks each against the
+// last Version observed on this instance.
+func refreshNS(c appengine.Context, ns string, keys []string) {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		dsKeys[i] = datastore.NewKey(c, Kind, k, 0, nil)
+	}
+	ents := make([]e, len(keys))
+	if err := datastore.GetMulti(c, dsKeys, ents); err != nil {
+		c.Errorf("error refreshing watched values in namespace %q: %v", ns, err)
+		return
+	}
+	for i, ent := range ents {
+		val := ent.Value
+		if ent.Encrypted {
+			if Encryption == nil {
+				c.Errorf("value for %q is encrypted but no Encryption cipher is configured", keys[i])
+				continue
+			}
+			plain, err := Encryption.Decrypt([]byte(ent.Value))
+			if err != nil {
+				c.Errorf("error decrypting %q: %v", keys[i], err)
+				continue
+			}
+			val = string(plain)
+		}
+		checkVersion(ns, keys[i], ent.Version, val)
+	}
+}
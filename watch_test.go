@@ -0,0 +1,61 @@
+// +build appengine
+
+package value
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestCheckVersionConcurrent exercises checkVersion and Watch from many
+// goroutines at once; run with -race to catch concurrent map access on
+// versions/watchers.
+func TestCheckVersionConcurrent(t *testing.T) {
+	var seen int32
+	var seenMu sync.Mutex
+	Watch("concurrent-key", func(string) {
+		seenMu.Lock()
+		seen++
+		seenMu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(v int64) {
+			defer wg.Done()
+			checkVersion("", "concurrent-key", v, "val")
+		}(int64(i))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	got := versions[nsKey("", "concurrent-key")]
+	mu.Unlock()
+	if got != 49 {
+		t.Fatalf("versions[key] = %d, want 49", got)
+	}
+}
+
+// TestCheckVersionNamespaced ensures two namespaces using the same key
+// name are tracked, and notified, independently.
+func TestCheckVersionNamespaced(t *testing.T) {
+	var gotA, gotB string
+	WatchNS("tenant-a", "shared-key", func(v string) { gotA = v })
+	WatchNS("tenant-b", "shared-key", func(v string) { gotB = v })
+
+	checkVersion("tenant-a", "shared-key", 1, "a-value")
+	if gotA != "a-value" {
+		t.Fatalf("tenant-a watcher got %q, want %q", gotA, "a-value")
+	}
+	if gotB != "" {
+		t.Fatalf("tenant-b watcher fired with %q, want no call", gotB)
+	}
+
+	mu.Lock()
+	_, ok := versions[nsKey("tenant-b", "shared-key")]
+	mu.Unlock()
+	if ok {
+		t.Fatalf("tenant-a's update leaked into tenant-b's version tracking")
+	}
+}